@@ -0,0 +1,207 @@
+package translator
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go.tools/go/types"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// archiveMagic identifies a package object file as using the structured
+// archive format implemented here, as opposed to the legacy "$$\n"-delimited
+// format written by earlier versions of GopherJS.
+var archiveMagic = [4]byte{'G', 'J', 'S', 'A'}
+
+// archiveVersion is bumped whenever the on-disk layout changes. Archives
+// written by a different version are treated as stale, forcing a rebuild
+// instead of risking silent corruption.
+const archiveVersion = 1
+
+// Archive is the structured, length-prefixed representation of everything a
+// dependent package needs in order to use a compiled GopherJS package
+// without reparsing its Go source: the generated JavaScript, the list of
+// import paths it depends on, a source-map fragment covering that
+// JavaScript, and the gc export data describing its types.
+type Archive struct {
+	ImportPath string
+	Imports    []string
+	JavaScript []byte
+	SourceMap  []byte
+	GcData     []byte
+}
+
+// WriteArchive writes a to w in the structured archive format: a small
+// header (magic + version), followed by each section length-prefixed with a
+// uint32.
+func WriteArchive(w io.Writer, a *Archive) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(archiveMagic[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.BigEndian, uint32(archiveVersion)); err != nil {
+		return err
+	}
+	if err := writeField(bw, []byte(a.ImportPath)); err != nil {
+		return err
+	}
+	if err := writeField(bw, []byte(joinImports(a.Imports))); err != nil {
+		return err
+	}
+	if err := writeField(bw, a.JavaScript); err != nil {
+		return err
+	}
+	if err := writeField(bw, a.SourceMap); err != nil {
+		return err
+	}
+	if err := writeField(bw, a.GcData); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadArchive reads an archive previously written by WriteArchive from br.
+// If br does not begin with archiveMagic, ReadArchive returns
+// errLegacyFormat so the caller can fall back to readLegacyPackageObject;
+// br is left unconsumed (aside from internal
+// buffering) in that case, since the magic check only peeks, so the caller
+// can keep reading from the same *bufio.Reader instead of losing whatever
+// it has already buffered from the underlying file.
+func ReadArchive(br *bufio.Reader) (*Archive, error) {
+	magic, err := br.Peek(len(archiveMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, archiveMagic[:]) {
+		return nil, errLegacyFormat
+	}
+	if _, err := io.ReadFull(br, make([]byte, len(archiveMagic))); err != nil {
+		return nil, err
+	}
+
+	var version uint32
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != archiveVersion {
+		return nil, errStaleArchive
+	}
+
+	importPath, err := readField(br)
+	if err != nil {
+		return nil, err
+	}
+	imports, err := readField(br)
+	if err != nil {
+		return nil, err
+	}
+	js, err := readField(br)
+	if err != nil {
+		return nil, err
+	}
+	sourceMap, err := readField(br)
+	if err != nil {
+		return nil, err
+	}
+	gcData, err := readField(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Archive{
+		ImportPath: string(importPath),
+		Imports:    splitImports(string(imports)),
+		JavaScript: js,
+		SourceMap:  sourceMap,
+		GcData:     gcData,
+	}, nil
+}
+
+// errLegacyFormat is returned by ReadArchive when the package object was
+// written by an older GopherJS that used the "$$\n"-delimited format.
+var errLegacyFormat = fmt.Errorf("package object uses the legacy archive format")
+
+// errStaleArchive is returned by ReadArchive when the archive header's
+// version does not match archiveVersion, meaning it was written by an
+// incompatible build of GopherJS and must be regenerated.
+var errStaleArchive = fmt.Errorf("package object archive version mismatch")
+
+func writeField(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readField(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func joinImports(imports []string) string {
+	var buf bytes.Buffer
+	for i, imp := range imports {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(imp)
+	}
+	return buf.String()
+}
+
+func splitImports(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := bytes.Split([]byte(s), []byte{'\n'})
+	imports := make([]string, len(parts))
+	for i, part := range parts {
+		imports[i] = string(part)
+	}
+	return imports
+}
+
+// readLegacyPackageObject reads a package object written in the old
+// "$$\n"-delimited format: raw JavaScript followed by a "$$\n" marker and
+// then gc export data. It is used to load package objects left over from
+// earlier GopherJS builds. When Translator.Cache is set, the next rebuild of
+// the package stores it in the structured format via Cache.Put; without
+// Cache, StoreArchive writes it in whatever format StoreArchive uses, so the
+// legacy object is not converted.
+func readLegacyPackageObject(r *bufio.Reader, importPath string, typesPackages map[string]*types.Package, pkgObj string) (*Archive, error) {
+	var jsCode []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if len(line) == 3 && string(line) == "$$\n" {
+			break
+		}
+		jsCode = append(jsCode, line...)
+	}
+
+	gcData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := types.GcImportData(typesPackages, pkgObj, importPath, bytes.NewReader(gcData)); err != nil {
+		return nil, err
+	}
+
+	return &Archive{
+		ImportPath: importPath,
+		JavaScript: jsCode,
+		GcData:     gcData,
+	}, nil
+}
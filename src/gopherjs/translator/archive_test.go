@@ -0,0 +1,54 @@
+package translator
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestWriteReadArchiveRoundTrip(t *testing.T) {
+	want := &Archive{
+		ImportPath: "example.com/foo",
+		Imports:    []string{"fmt", "os"},
+		JavaScript: []byte("console.log('hi');"),
+		SourceMap:  []byte(`{"version":3}`),
+		GcData:     []byte{0x01, 0x02, 0x03},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, want); err != nil {
+		t.Fatalf("WriteArchive: %v", err)
+	}
+
+	got, err := ReadArchive(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("ReadArchive: %v", err)
+	}
+
+	if got.ImportPath != want.ImportPath ||
+		!stringSlicesEqual(got.Imports, want.Imports) ||
+		!bytes.Equal(got.JavaScript, want.JavaScript) ||
+		!bytes.Equal(got.SourceMap, want.SourceMap) ||
+		!bytes.Equal(got.GcData, want.GcData) {
+		t.Fatalf("ReadArchive(WriteArchive(a)) = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadArchiveLegacyFormat(t *testing.T) {
+	br := bufio.NewReader(bytes.NewReader([]byte("not a structured archive")))
+	if _, err := ReadArchive(br); err != errLegacyFormat {
+		t.Fatalf("ReadArchive on non-magic input = %v, want errLegacyFormat", err)
+	}
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package translator
+
+import (
+	"bufio"
+	"go/build"
+	"sort"
+	"strings"
+)
+
+// jsFileSuffix mirrors Go's own "_GOOS.go" build-constraint convention
+// (e.g. "foo_linux.go"), but for GopherJS's "js" pseudo-platform: a file
+// named "foo_js.go" is always built for the JS target, letting packages
+// shadow platform-specific pieces of "syscall", "runtime" and "reflect"
+// the same way they would for a real GOOS.
+const jsFileSuffix = "_js.go"
+
+// applyBuildTags sets BuildContext.BuildTags so that "// +build js" (and,
+// going forward, "//go:build js") constraints are satisfied during Import,
+// along with "gopherjs" and anything the caller added via
+// Translator.BuildTags.
+func (t *Translator) applyBuildTags() {
+	tags := t.buildTagSet()
+	merged := make([]string, 0, len(tags))
+	for tag := range tags {
+		merged = append(merged, tag)
+	}
+	sort.Strings(merged)
+	t.BuildContext.BuildTags = merged
+}
+
+func (t *Translator) buildTagSet() map[string]bool {
+	tags := map[string]bool{"js": true, "gopherjs": true}
+	for _, tag := range t.BuildTags {
+		tags[tag] = true
+	}
+	return tags
+}
+
+// filterJSGoFiles re-derives the list of Go files to compile for pkg, taking
+// GopherJS's build conventions into account on top of whatever
+// BuildContext.Import already decided:
+//
+//   - any "foo_js.go" file is always included, even though plain go/build
+//     may not recognize "js" as a GOOS and so would otherwise have filed it
+//     under GoFiles or IgnoredGoFiles depending on the host toolchain; and
+//   - any file go/build excluded under IgnoredGoFiles purely because its
+//     own "// +build"/"//go:build" line requires a tag we do set (js,
+//     gopherjs, or a caller-provided tag) is re-admitted.
+func (t *Translator) filterJSGoFiles(pkg *build.Package) ([]string, error) {
+	tags := t.buildTagSet()
+
+	files := make([]string, 0, len(pkg.GoFiles))
+	for _, name := range pkg.GoFiles {
+		files = append(files, name)
+	}
+
+	var extra []string
+	for _, name := range pkg.IgnoredGoFiles {
+		if strings.HasSuffix(name, jsFileSuffix) {
+			extra = append(extra, name)
+			continue
+		}
+		matches, err := t.fileMatchesBuildTags(pkg.Dir+"/"+name, tags)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+
+	return append(files, extra...), nil
+}
+
+// fileMatchesBuildTags reports whether any "// +build" or "//go:build"
+// constraint line in the leading comment block of the file at path is
+// satisfied by tags. In a "//go:build" line, "&&" and "||" are supported;
+// grouping parentheses are not interpreted.
+func (t *Translator) fileMatchesBuildTags(path string, tags map[string]bool) (bool, error) {
+	f, err := t.BuildContext.OpenFile(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			break // past the leading comment block; constraints must precede the package clause
+		}
+
+		constraint := strings.TrimSpace(strings.TrimPrefix(line, "//"))
+		switch {
+		case strings.HasPrefix(constraint, "go:build "):
+			constraint = strings.TrimPrefix(constraint, "go:build ")
+			// Rewrite into "+build" syntax: "&&" becomes "," and "||" a space.
+			constraint = strings.NewReplacer(" ", "", "&&", ",", "||", " ").Replace(constraint)
+		case strings.HasPrefix(constraint, "+build "):
+			constraint = strings.TrimPrefix(constraint, "+build ")
+		default:
+			continue
+		}
+
+		if constraintSatisfied(constraint, tags) {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// constraintSatisfied reports whether a "+build" line is satisfied by tags.
+// Space-separated terms are OR'd; within a term, comma-separated options are
+// AND'd; an option prefixed with "!" is satisfied when tags does NOT contain
+// it.
+func constraintSatisfied(constraint string, tags map[string]bool) bool {
+	for _, term := range strings.Fields(constraint) {
+		if termSatisfied(term, tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func termSatisfied(term string, tags map[string]bool) bool {
+	for _, opt := range strings.Split(term, ",") {
+		negate := strings.HasPrefix(opt, "!")
+		opt = strings.Trim(strings.TrimPrefix(opt, "!"), "()")
+		if tags[opt] == negate {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package translator
+
+import (
+	"bytes"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestFilterJSGoFiles(t *testing.T) {
+	files := map[string]string{
+		"/pkg/foo_js.go":    "package pkg\n",
+		"/pkg/foo_other.go": "// +build !js\n\npackage pkg\n",
+		"/pkg/bar_plan9.go": "// +build plan9\n\npackage pkg\n",
+	}
+
+	tr := &Translator{
+		BuildContext: &build.Context{
+			OpenFile: func(path string) (io.ReadCloser, error) {
+				content, ok := files[path]
+				if !ok {
+					return nil, os.ErrNotExist
+				}
+				return ioutil.NopCloser(bytes.NewReader([]byte(content))), nil
+			},
+		},
+	}
+
+	pkg := &build.Package{
+		Dir:            "/pkg",
+		IgnoredGoFiles: []string{"foo_js.go", "foo_other.go", "bar_plan9.go"},
+	}
+
+	got, err := tr.filterJSGoFiles(pkg)
+	if err != nil {
+		t.Fatalf("filterJSGoFiles: %v", err)
+	}
+	sort.Strings(got)
+
+	want := []string{"foo_js.go"}
+	if !stringSlicesEqual(got, want) {
+		t.Fatalf("filterJSGoFiles = %v, want %v (foo_js.go must always be re-admitted; "+
+			"foo_other.go's \"!js\" must stay excluded since js is set; bar_plan9.go requires a tag we don't set)",
+			got, want)
+	}
+}
+
+func TestTermSatisfiedNegation(t *testing.T) {
+	tags := map[string]bool{"js": true, "gopherjs": true}
+
+	cases := []struct {
+		term string
+		want bool
+	}{
+		{"js", true},
+		{"!js", false},
+		{"linux", false},
+		{"!linux", true},
+		{"js,gopherjs", true},
+		{"js,!gopherjs", false},
+	}
+	for _, c := range cases {
+		if got := termSatisfied(c.term, tags); got != c.want {
+			t.Errorf("termSatisfied(%q) = %v, want %v", c.term, got, c.want)
+		}
+	}
+}
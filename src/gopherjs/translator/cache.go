@@ -0,0 +1,159 @@
+package translator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ArchiveCache stores and retrieves the archives BuildPackage encodes with
+// WriteArchive, keyed by import path. Implementations decide where the bytes actually
+// live: on the local disk (FilesystemCache), in memory for watch/serve
+// mode (MemoryCache), or on a shared network store for CI.
+type ArchiveCache interface {
+	// Get returns the cached archive for importPath, provided it is not
+	// older than srcModTime. found is false if there is no usable cached
+	// archive (missing or stale), in which case the caller should rebuild.
+	Get(importPath string, srcModTime time.Time) (archive io.ReadCloser, found bool, err error)
+
+	// Put stores data as the archive for importPath.
+	Put(importPath string, data []byte) error
+}
+
+// ContentHash returns the hex-encoded sha256 of data, usable as a
+// machine-independent cache key so archives can be shared across machines
+// (e.g. a CI cache) instead of only within one filesystem.
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// FilesystemCache stores archives as files at the path PkgObjPath returns
+// for each import path, matching GopherJS's traditional behavior of writing
+// one package object per import path. PkgObjPath must be set.
+type FilesystemCache struct {
+	// PkgObjPath, given an import path, returns the file path the archive
+	// for that package is stored at (typically the same path the Go
+	// toolchain would use for the compiled .a file).
+	PkgObjPath func(importPath string) string
+}
+
+func (c *FilesystemCache) Get(importPath string, srcModTime time.Time) (io.ReadCloser, bool, error) {
+	path := c.PkgObjPath(importPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if info.ModTime().Before(srcModTime) {
+		return nil, false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+func (c *FilesystemCache) Put(importPath string, data []byte) error {
+	path := c.PkgObjPath(importPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// MemoryCache keeps archives in memory, so that `gopherjs serve`/watch mode
+// rebuilds don't round-trip through disk for every package on every save.
+type MemoryCache struct {
+	mu      sync.Mutex
+	data    map[string][]byte
+	modTime map[string]time.Time
+}
+
+// NewMemoryCache returns an empty, ready-to-use MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		data:    make(map[string][]byte),
+		modTime: make(map[string]time.Time),
+	}
+}
+
+func (c *MemoryCache) Get(importPath string, srcModTime time.Time) (io.ReadCloser, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, found := c.data[importPath]
+	if !found || c.modTime[importPath].Before(srcModTime) {
+		return nil, false, nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), true, nil
+}
+
+func (c *MemoryCache) Put(importPath string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stored := make([]byte, len(data))
+	copy(stored, data)
+	c.data[importPath] = stored
+	c.modTime[importPath] = nowFunc()
+	return nil
+}
+
+// nowFunc is a var so tests can stub out the current time; it otherwise
+// behaves exactly like time.Now.
+var nowFunc = time.Now
+
+// legacyCache adapts a Translator's GetModTime/StoreArchive/BuildContext
+// fields to the ArchiveCache interface, so BuildPackage can go through a
+// single ArchiveCache-shaped code path regardless of whether the caller set
+// Cache or is still using the older filesystem-backed fields. It holds a
+// direct reference to pkg because, unlike a real ArchiveCache, GetModTime/
+// StoreArchive key off of pkg.PkgObj rather than the import path.
+type legacyCache struct {
+	t   *Translator
+	pkg *GopherPackage
+}
+
+func (c legacyCache) Get(importPath string, srcModTime time.Time) (io.ReadCloser, bool, error) {
+	if c.pkg.PkgObj == "" {
+		return nil, false, nil
+	}
+	pkgObjModTime := c.t.GetModTime(c.pkg.PkgObj)
+	if pkgObjModTime.Unix() == 0 || srcModTime.After(pkgObjModTime) {
+		return nil, false, nil
+	}
+	f, err := c.t.BuildContext.OpenFile(c.pkg.PkgObj)
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+func (c legacyCache) Put(importPath string, data []byte) error {
+	// StoreArchive takes the live *GopherPackage, not serialized bytes: it
+	// predates the structured Archive format and is free to write pkg.PkgObj
+	// however it always has. data is ignored so that behavior is preserved
+	// exactly for callers who haven't switched to Cache.
+	return c.t.StoreArchive(c.pkg)
+}
+
+// cacheFor returns the ArchiveCache BuildPackage should use to load and
+// store pkg's archive: t.Cache if the caller set one, otherwise a
+// legacyCache wrapping the older GetModTime/StoreArchive fields so both
+// paths are reached through the same interface.
+func (t *Translator) cacheFor(pkg *GopherPackage) ArchiveCache {
+	if t.Cache != nil {
+		return t.Cache
+	}
+	return legacyCache{t: t, pkg: pkg}
+}
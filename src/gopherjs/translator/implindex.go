@@ -0,0 +1,142 @@
+package translator
+
+import (
+	"code.google.com/p/go.tools/go/types"
+)
+
+// methodNameSet collects every method name exposed by t, including ones
+// promoted through struct embedding, for use as an approximate key in
+// methodSetIndex below. It doesn't need to be exact: every candidate it
+// helps surface is still confirmed with types.IsAssignableTo before being
+// recorded as implementing an interface.
+func methodNameSet(t types.Type) map[string]bool {
+	names := make(map[string]bool)
+
+	if in, ok := t.Underlying().(*types.Interface); ok {
+		ms := in.MethodSet()
+		for i := 0; i < ms.Len(); i++ {
+			names[ms.At(i).Obj().Name()] = true
+		}
+		return names
+	}
+
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	if named, ok := t.(*types.Named); ok {
+		collectNamedMethodNames(named, make(map[*types.Named]bool), names)
+	}
+	return names
+}
+
+// collectNamedMethodNames walks named's explicitly declared methods plus,
+// recursively, those promoted from anonymous (embedded) fields.
+func collectNamedMethodNames(named *types.Named, seen map[*types.Named]bool, out map[string]bool) {
+	if seen[named] {
+		return
+	}
+	seen[named] = true
+
+	for i := 0; i < named.NumMethods(); i++ {
+		out[named.Method(i).Name()] = true
+	}
+
+	st, ok := named.Underlying().(*types.Struct)
+	if !ok {
+		return
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		field := st.Field(i)
+		if !field.Anonymous() {
+			continue
+		}
+		ft := field.Type()
+		if ptr, ok := ft.(*types.Pointer); ok {
+			ft = ptr.Elem()
+		}
+		embedded, ok := ft.(*types.Named)
+		if !ok {
+			continue
+		}
+		if in, ok := embedded.Underlying().(*types.Interface); ok {
+			// An embedded interface promotes its whole method set, not
+			// methods declared directly on embedded's *types.Named (it has
+			// none), so it needs its own MethodSet() walk rather than
+			// recursing into collectNamedMethodNames.
+			ms := in.MethodSet()
+			for i := 0; i < ms.Len(); i++ {
+				out[ms.At(i).Obj().Name()] = true
+			}
+			continue
+		}
+		collectNamedMethodNames(embedded, seen, out)
+	}
+}
+
+// methodSetIndex maps a method name to every concrete (non-interface) type
+// name in allTypeNames whose method set contains it, turning "which types
+// implement this interface" from a scan of every type into an intersection
+// of a handful of posting lists.
+type methodSetIndex struct {
+	byMethodName map[string][]*types.TypeName
+}
+
+// newMethodSetIndex builds the posting lists for every concrete type in
+// allTypeNames. Interfaces are skipped; only concrete types can implement
+// another interface for the purposes of Go$implementedBy.
+func newMethodSetIndex(allTypeNames []*types.TypeName) *methodSetIndex {
+	idx := &methodSetIndex{byMethodName: make(map[string][]*types.TypeName)}
+	for _, tn := range allTypeNames {
+		t := tn.Type()
+		if _, isInterface := t.Underlying().(*types.Interface); isInterface {
+			continue
+		}
+		if _, isStruct := t.Underlying().(*types.Struct); isStruct {
+			t = types.NewPointer(t)
+		}
+		for name := range methodNameSet(t) {
+			idx.byMethodName[name] = append(idx.byMethodName[name], tn)
+		}
+	}
+	return idx
+}
+
+// candidates returns the concrete type names that could possibly implement
+// in, found by intersecting the posting lists of in's required method
+// names (starting from the shortest list). The caller must still confirm
+// each result with types.IsAssignableTo; this only narrows what would
+// otherwise be a quadratic scan down to a small set worth checking.
+func (idx *methodSetIndex) candidates(in *types.Interface) []*types.TypeName {
+	required := methodNameSet(in)
+	if len(required) == 0 {
+		return nil
+	}
+
+	var shortest []*types.TypeName
+	for name := range required {
+		list := idx.byMethodName[name]
+		if shortest == nil || len(list) < len(shortest) {
+			shortest = list
+		}
+	}
+
+	candidates := make([]*types.TypeName, 0, len(shortest))
+	for _, tn := range shortest {
+		t := tn.Type()
+		if _, isStruct := t.Underlying().(*types.Struct); isStruct {
+			t = types.NewPointer(t)
+		}
+		names := methodNameSet(t)
+		hasAll := true
+		for name := range required {
+			if !names[name] {
+				hasAll = false
+				break
+			}
+		}
+		if hasAll {
+			candidates = append(candidates, tn)
+		}
+	}
+	return candidates
+}
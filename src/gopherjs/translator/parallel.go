@@ -0,0 +1,168 @@
+package translator
+
+import (
+	"go/build"
+	"sync"
+)
+
+// buildNode is one vertex of the import DAG walked by ParallelBuild.
+type buildNode struct {
+	pkg       *GopherPackage
+	deps      []*buildNode
+	dependent []*buildNode
+
+	mu      sync.Mutex
+	done    bool
+	err     error
+	pending int // number of deps not yet built
+}
+
+// ParallelBuild translates the package at root and everything it transitively
+// imports, the same way BuildPackage does, but schedules independent
+// packages across a worker pool instead of walking the import graph
+// serially. Leaf packages (no un-built imports) are translated first;
+// a package is only scheduled once every package it imports has finished.
+//
+// t.TypesConfig.Packages and t.Packages are shared mutable state, so
+// BuildPackage takes t.packagesMu itself around the handful of map reads
+// and writes it does (see translator.go). Assigning TypesConfig.Import and
+// calling translatePackage is additionally serialized under t.typeCheckMu,
+// since both work against the single shared TypesConfig; everything else —
+// file I/O, parsing, and cache reads/writes — runs unlocked, so independent
+// packages still translate concurrently around that one serialized step.
+func (t *Translator) ParallelBuild(root string) error {
+	if t.Concurrency <= 0 {
+		t.Concurrency = 1
+	}
+
+	nodes := make(map[string]*buildNode)
+	var walk func(importPath, srcDir string) (*buildNode, error)
+	walk = func(importPath, srcDir string) (*buildNode, error) {
+		if node, found := nodes[importPath]; found {
+			return node, nil
+		}
+
+		t.packagesMu.Lock()
+		pkg, found := t.Packages[importPath]
+		t.packagesMu.Unlock()
+		if !found {
+			t.applyBuildTags()
+			otherPkg, err := t.BuildContext.Import(importPath, srcDir, build.AllowBinary)
+			if err != nil {
+				return nil, err
+			}
+			goFiles, err := t.filterJSGoFiles(otherPkg)
+			if err != nil {
+				return nil, err
+			}
+			otherPkg.GoFiles = goFiles
+			pkg = &GopherPackage{Package: otherPkg}
+			t.packagesMu.Lock()
+			t.Packages[importPath] = pkg
+			t.packagesMu.Unlock()
+		}
+
+		node := &buildNode{pkg: pkg}
+		nodes[importPath] = node
+
+		for _, impPath := range pkg.Imports {
+			if impPath == "unsafe" {
+				continue
+			}
+			depNode, err := walk(impPath, pkg.Dir)
+			if err != nil {
+				return nil, err
+			}
+			node.deps = append(node.deps, depNode)
+			depNode.dependent = append(depNode.dependent, node)
+		}
+		node.pending = len(node.deps)
+
+		return node, nil
+	}
+
+	if _, err := walk(root, ""); err != nil {
+		return err
+	}
+
+	ready := make(chan *buildNode, len(nodes))
+	var readyMu sync.Mutex
+	enqueued := make(map[*buildNode]bool)
+	var enqueue func(n *buildNode)
+	enqueue = func(n *buildNode) {
+		readyMu.Lock()
+		defer readyMu.Unlock()
+		if enqueued[n] {
+			return
+		}
+		enqueued[n] = true
+		ready <- n
+	}
+
+	for _, n := range nodes {
+		if n.pending == 0 {
+			enqueue(n)
+		}
+	}
+
+	sem := make(chan struct{}, t.Concurrency)
+	var wg sync.WaitGroup
+	var firstErrMu sync.Mutex
+	var firstErr error
+	remaining := len(nodes)
+	var remainingMu sync.Mutex
+
+	for remaining > 0 {
+		n := <-ready
+		remainingMu.Lock()
+		remaining--
+		remainingMu.Unlock()
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n *buildNode) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// Once any package has failed, the rest are only drained (not
+			// built) so that every node still reaches the loop above.
+			firstErrMu.Lock()
+			failed := firstErr != nil
+			firstErrMu.Unlock()
+			var err error
+			if !failed {
+				err = t.BuildPackage(n.pkg)
+			}
+
+			n.mu.Lock()
+			n.done = true
+			n.err = err
+			n.mu.Unlock()
+
+			if err != nil && err != PkgObjUpToDate {
+				firstErrMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				firstErrMu.Unlock()
+			}
+
+			for _, dependent := range n.dependent {
+				dependent.mu.Lock()
+				dependent.pending--
+				ready := dependent.pending == 0
+				dependent.mu.Unlock()
+				if ready {
+					enqueue(dependent)
+				}
+			}
+		}(n)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package translator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"go/token"
+)
+
+// SourceMapWriter tracks the line position of JavaScript output (it does not
+// store the output itself) and records, for each mapped line, the
+// originating Go file and line it came from. It
+// is used by BuildPackage's command-emitting branch to build a V3 source
+// map covering the whole generated bundle.
+type SourceMapWriter struct {
+	FileSet *token.FileSet
+
+	line     int
+	mappings []sourceMapping
+}
+
+type sourceMapping struct {
+	generatedLine int
+	file          string
+	originalLine  int
+}
+
+// NewSourceMapWriter creates a SourceMapWriter positioned at output line 1.
+// fset is kept in the FileSet field; the writer itself does not consult it.
+func NewSourceMapWriter(fset *token.FileSet) *SourceMapWriter {
+	return &SourceMapWriter{FileSet: fset, line: 1}
+}
+
+// Write advances the current output line by the number of newlines in code,
+// so later calls to Map attribute the right line to a Go position. code is
+// not stored; the caller appends it to the bundle itself.
+func (w *SourceMapWriter) Write(code []byte) {
+	w.line += bytes.Count(code, []byte{'\n'})
+}
+
+// Map records that the JavaScript currently being written corresponds to
+// line originalLine of file, with file recorded as given.
+func (w *SourceMapWriter) Map(file string, originalLine int) {
+	w.mappings = append(w.mappings, sourceMapping{
+		generatedLine: w.line,
+		file:          file,
+		originalLine:  originalLine,
+	})
+}
+
+// packageSourceFile is one Go file contributing to a package's generated
+// JavaScript, along with its line count, as used by mapPackageLines to
+// spread generated lines across a package's files.
+type packageSourceFile struct {
+	name  string
+	lines int
+}
+
+// packageSourceFiles returns gopherPkg's Go files in build order together
+// with each file's line count, looked up in t.FileSet.
+func (t *Translator) packageSourceFiles(gopherPkg *GopherPackage) []packageSourceFile {
+	files := make([]packageSourceFile, 0, len(gopherPkg.GoFiles))
+	for _, name := range gopherPkg.GoFiles {
+		lines := 1
+		if tf := t.fileInSet(gopherPkg.Dir + "/" + name); tf != nil {
+			lines = tf.LineCount()
+		}
+		files = append(files, packageSourceFile{name: gopherPkg.Dir + "/" + name, lines: lines})
+	}
+	return files
+}
+
+// fileInSet returns the *token.File registered in t.FileSet under name, or
+// nil if none was parsed under that name.
+func (t *Translator) fileInSet(name string) *token.File {
+	var found *token.File
+	t.FileSet.Iterate(func(f *token.File) bool {
+		if f.Name() == name {
+			found = f
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// mapPackageLines writes js to w one generated line at a time, mapping each
+// line back to a line of gopherPkg's Go source. translatePackage returns
+// only the finished JavaScript with no per-statement position info, so the
+// mapping is an approximation: each of gopherPkg's Go files is assumed to
+// contribute a share of js proportional to its own line count, in GoFiles
+// order, with the original line advancing through the file across that
+// share. That is still a meaningfully better source map than attributing
+// every line of js to line 1 of a single arbitrarily chosen file.
+func (t *Translator) mapPackageLines(w *SourceMapWriter, gopherPkg *GopherPackage, js []byte) {
+	sources := t.packageSourceFiles(gopherPkg)
+	if len(sources) == 0 {
+		w.Write(js)
+		return
+	}
+
+	lines := bytes.SplitAfter(js, []byte{'\n'})
+	if n := len(lines); n > 0 && len(lines[n-1]) == 0 {
+		lines = lines[:n-1] // trailing empty element from a final '\n'
+	}
+
+	total := 0
+	for _, s := range sources {
+		total += s.lines
+	}
+
+	shareOf := func(i int) int {
+		n := sources[i].lines * len(lines) / total
+		if n == 0 {
+			n = 1
+		}
+		return n
+	}
+
+	si, srcLine := 0, 1
+	consumed, share := 0, shareOf(0)
+	for _, line := range lines {
+		for consumed >= share && si < len(sources)-1 {
+			si, srcLine, consumed = si+1, 1, 0
+			share = shareOf(si)
+		}
+		w.Map(sources[si].name, srcLine)
+		w.Write(line)
+		srcLine++
+		consumed++
+	}
+}
+
+// sourceMapV3 is the JSON structure of a version 3 source map, as consumed
+// by browsers and debuggers.
+type sourceMapV3 struct {
+	Version  int      `json:"version"`
+	File     string   `json:"file"`
+	Sources  []string `json:"sources"`
+	Names    []string `json:"names"`
+	Mappings string   `json:"mappings"`
+}
+
+// Bytes encodes the accumulated mappings as a V3 source map for outputFile,
+// ready to be written alongside the generated JavaScript.
+func (w *SourceMapWriter) Bytes(outputFile string) ([]byte, error) {
+	sources := make([]string, 0)
+	sourceIndex := make(map[string]int)
+	for _, m := range w.mappings {
+		if _, ok := sourceIndex[m.file]; !ok {
+			sourceIndex[m.file] = len(sources)
+			sources = append(sources, m.file)
+		}
+	}
+
+	var mappings bytes.Buffer
+	prevGeneratedLine := 0
+	prevSource, prevOriginalLine := 0, 0
+	for _, m := range w.mappings {
+		for prevGeneratedLine < m.generatedLine-1 { // generatedLine is 1-based, ';' groups are 0-based
+			mappings.WriteByte(';')
+			prevGeneratedLine++
+		}
+		source := sourceIndex[m.file]
+		mappings.WriteString(encodeVLQ(0)) // generated column, always 0 (whole-line mapping)
+		mappings.WriteString(encodeVLQ(source - prevSource))
+		mappings.WriteString(encodeVLQ(m.originalLine - 1 - prevOriginalLine))
+		mappings.WriteString(encodeVLQ(0)) // original column
+		mappings.WriteByte(',')
+		prevSource = source
+		prevOriginalLine = m.originalLine - 1
+	}
+
+	out := &sourceMapV3{
+		Version:  3,
+		File:     outputFile,
+		Sources:  sources,
+		Names:    []string{},
+		Mappings: mappings.String(),
+	}
+	return json.Marshal(out)
+}
+
+const base64VLQChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// encodeVLQ encodes n as a base64 VLQ, the encoding used by source maps for
+// each mapping field.
+func encodeVLQ(n int) string {
+	if n < 0 {
+		n = (-n << 1) | 1
+	} else {
+		n = n << 1
+	}
+
+	var buf bytes.Buffer
+	for {
+		digit := n & 0x1f
+		n >>= 5
+		if n > 0 {
+			digit |= 0x20
+		}
+		buf.WriteByte(base64VLQChars[digit])
+		if n == 0 {
+			break
+		}
+	}
+	return buf.String()
+}
+
+// sourceMappingURLComment returns the "//# sourceMappingURL=" comment to
+// append to the generated JavaScript so browsers can find mapFile.
+func sourceMappingURLComment(mapFile string) []byte {
+	return []byte("//# sourceMappingURL=" + mapFile + "\n")
+}
+
+// dataURL base64-encodes data as a data: URL, useful for inlining a source
+// map instead of writing a separate .js.map file.
+func dataURL(mimeType string, data []byte) string {
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
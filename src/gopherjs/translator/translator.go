@@ -2,6 +2,7 @@ package translator
 
 import (
 	"bufio"
+	"bytes"
 	"code.google.com/p/go.tools/go/types"
 	"fmt"
 	"go/ast"
@@ -9,7 +10,9 @@ import (
 	"go/parser"
 	"go/scanner"
 	"go/token"
+	"io"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,12 +23,75 @@ type Translator struct {
 	StoreArchive func(*GopherPackage) error
 	FileSet      *token.FileSet
 	Packages     map[string]*GopherPackage
+	// Concurrency is the number of packages ParallelBuild will translate at
+	// once. Values <= 0 are treated as 1 (fully serial, matching BuildPackage).
+	Concurrency int
+
+	// BuildTags are additional build tags (beyond the always-set "js" and
+	// "gopherjs") to satisfy when importing packages, e.g. for picking a
+	// compile-time configuration the way "go build -tags" would.
+	BuildTags []string
+
+	// Cache, when set, is used instead of StoreArchive and of the
+	// GetModTime/BuildContext.OpenFile check of pkg.PkgObj to load and
+	// persist package archives; GetModTime is still used for the
+	// modification times of source files. This is
+	// what lets the up-to-date check and archive storage be backed by
+	// something other than the local filesystem (e.g. MemoryCache for
+	// `gopherjs serve`, or a shared cache for CI). When Cache is nil,
+	// BuildPackage falls back to a legacyCache wrapping GetModTime and
+	// StoreArchive, so both cases are driven through the same ArchiveCache
+	// interface rather than two separate code paths.
+	Cache ArchiveCache
+
+	// GcExportData, when set, is called after type-checking to obtain the gc
+	// export data describing pkg's types (e.g. by invoking the Go
+	// toolchain's own export writer on pkg.PkgObj), and the result is stored
+	// in pkg.GcData before the archive is written. Translator has no type
+	// checker of its own capable of producing export data, so without this
+	// hook archives are written with an empty GcData.
+	GcExportData func(pkg *GopherPackage) ([]byte, error)
+
+	// packagesMu guards every read/write of TypesConfig.Packages and
+	// Packages. It costs nothing when BuildPackage is only ever called from
+	// one goroutine, but is what keeps those two maps safe once
+	// ParallelBuild is translating more than one package at a time.
+	packagesMu sync.Mutex
+
+	// typeCheckMu serializes assignment of TypesConfig.Import and the
+	// translatePackage call that relies on it: both work against the single
+	// shared TypesConfig, so two packages being translated concurrently by
+	// ParallelBuild would otherwise race on TypesConfig.Import (one
+	// package's closure, capturing its own directory, can be overwritten by
+	// another's before it's invoked) and on the type checker itself, which
+	// isn't safe for concurrent use across packages. File I/O, parsing, and
+	// cache reads/writes around this section still run unlocked.
+	typeCheckMu sync.Mutex
 }
 
 type GopherPackage struct {
 	*build.Package
 	SrcModTime     time.Time
 	JavaScriptCode []byte
+	SourceMap      []byte
+	// GcData holds the gc export data describing this package's types, for
+	// embedding in the archive written to the cache. It is populated by
+	// Translator.GcExportData after type-checking, since this package does
+	// not itself produce export data.
+	GcData []byte
+}
+
+// Archive returns the structured archive representation of pkg, suitable
+// for passing to WriteArchive. It is the counterpart to ReadArchive used on
+// the up-to-date loading path in BuildPackage.
+func (pkg *GopherPackage) Archive() *Archive {
+	return &Archive{
+		ImportPath: pkg.ImportPath,
+		Imports:    pkg.Imports,
+		JavaScript: pkg.JavaScriptCode,
+		SourceMap:  pkg.SourceMap,
+		GcData:     pkg.GcData,
+	}
 }
 
 type ErrorList []error
@@ -37,16 +103,27 @@ func (err ErrorList) Error() string {
 var PkgObjUpToDate = fmt.Errorf("Package object already up-to-date.")
 
 func (t *Translator) getPackage(importPath string, srcDir string) (*GopherPackage, error) {
-	if pkg, found := t.Packages[importPath]; found {
+	t.packagesMu.Lock()
+	pkg, found := t.Packages[importPath]
+	t.packagesMu.Unlock()
+	if found {
 		return pkg, nil
 	}
 
+	t.applyBuildTags()
 	otherPkg, err := t.BuildContext.Import(importPath, srcDir, build.AllowBinary)
 	if err != nil {
 		return nil, err
 	}
-	pkg := &GopherPackage{Package: otherPkg}
+	goFiles, err := t.filterJSGoFiles(otherPkg)
+	if err != nil {
+		return nil, err
+	}
+	otherPkg.GoFiles = goFiles
+	pkg = &GopherPackage{Package: otherPkg}
+	t.packagesMu.Lock()
 	t.Packages[importPath] = pkg
+	t.packagesMu.Unlock()
 	if err := t.BuildPackage(pkg); err != nil && err != PkgObjUpToDate {
 		return nil, err
 	}
@@ -55,7 +132,9 @@ func (t *Translator) getPackage(importPath string, srcDir string) (*GopherPackag
 
 func (t *Translator) BuildPackage(pkg *GopherPackage) error {
 	if pkg.ImportPath == "unsafe" {
+		t.packagesMu.Lock()
 		t.TypesConfig.Packages["unsafe"] = types.Unsafe
+		t.packagesMu.Unlock()
 		return nil
 	}
 
@@ -78,37 +157,58 @@ func (t *Translator) BuildPackage(pkg *GopherPackage) error {
 		}
 	}
 
-	pkgObjModTime := t.GetModTime(pkg.PkgObj)
-	if pkgObjModTime.Unix() != 0 && !pkg.SrcModTime.After(pkgObjModTime) && pkg.PkgObj != "" {
+	cache := t.cacheFor(pkg)
+
+	var objFile io.ReadCloser
+	cached, found, err := cache.Get(pkg.ImportPath, pkg.SrcModTime)
+	if err != nil {
+		return err
+	}
+	if found {
+		objFile = cached
+	}
+
+	if objFile != nil {
 		// package object is up to date, load from disk if library
 		if pkg.IsCommand() {
+			objFile.Close()
 			return PkgObjUpToDate
 		}
 
-		objFile, err := t.BuildContext.OpenFile(pkg.PkgObj)
-		if err != nil {
-			return err
-		}
 		defer objFile.Close()
 
-		r := bufio.NewReader(objFile)
-		for {
-			line, err := r.ReadSlice('\n')
-			if err != nil && err != bufio.ErrBufferFull {
-				return err
+		br := bufio.NewReader(objFile)
+		archive, err := ReadArchive(br)
+		if err == errLegacyFormat {
+			// Package object was written by an older GopherJS. Load it the
+			// old way, from the same buffered reader so nothing peeked
+			// during format detection is lost. Only Cache.Put, on the next
+			// rebuild, stores it in the structured format; StoreArchive
+			// writes its own format. readLegacyPackageObject
+			// writes into t.TypesConfig.Packages via types.GcImportData, so
+			// it needs packagesMu held the same as the branch below.
+			t.packagesMu.Lock()
+			archive, err = readLegacyPackageObject(br, pkg.ImportPath, t.TypesConfig.Packages, pkg.PkgObj)
+			t.packagesMu.Unlock()
+		}
+		switch err {
+		case nil:
+			pkg.JavaScriptCode = archive.JavaScript
+			t.packagesMu.Lock()
+			if t.TypesConfig.Packages[pkg.ImportPath] == nil {
+				t.TypesConfig.Packages[pkg.ImportPath], err = types.GcImportData(t.TypesConfig.Packages, pkg.PkgObj, pkg.ImportPath, bytes.NewReader(archive.GcData))
 			}
-			if len(line) == 3 && string(line) == "$$\n" {
-				break
+			t.packagesMu.Unlock()
+			if err != nil {
+				return err
 			}
-			pkg.JavaScriptCode = append(pkg.JavaScriptCode, line...)
-		}
-
-		t.TypesConfig.Packages[pkg.ImportPath], err = types.GcImportData(t.TypesConfig.Packages, pkg.PkgObj, pkg.ImportPath, r)
-		if err != nil {
+			return PkgObjUpToDate
+		case errStaleArchive:
+			// Archive format changed underneath us; fall through and
+			// rebuild from source instead of risking silent corruption.
+		default:
 			return err
 		}
-
-		return PkgObjUpToDate
 	}
 
 	files := make([]*ast.File, 0)
@@ -136,6 +236,7 @@ func (t *Translator) BuildPackage(pkg *GopherPackage) error {
 		return errList
 	}
 
+	t.typeCheckMu.Lock()
 	t.TypesConfig.Import = func(imports map[string]*types.Package, path string) (*types.Package, error) {
 		_, err := t.getPackage(path, pkg.Dir)
 		if err != nil {
@@ -143,20 +244,34 @@ func (t *Translator) BuildPackage(pkg *GopherPackage) error {
 		}
 		return imports[path], nil
 	}
-	var err error
 	pkg.JavaScriptCode, err = translatePackage(pkg.ImportPath, files, t.FileSet, t.TypesConfig)
+	t.typeCheckMu.Unlock()
 	if err != nil {
 		return err
 	}
 
 	if !pkg.IsCommand() {
-		return t.StoreArchive(pkg)
+		if t.GcExportData != nil {
+			gcData, err := t.GcExportData(pkg)
+			if err != nil {
+				return err
+			}
+			pkg.GcData = gcData
+		}
+		var buf bytes.Buffer
+		if err := WriteArchive(&buf, pkg.Archive()); err != nil {
+			return err
+		}
+		return cache.Put(pkg.ImportPath, buf.Bytes())
 	}
 
 	var jsCode []byte
 	jsCode = []byte(strings.TrimSpace(prelude))
 	jsCode = append(jsCode, '\n')
 
+	sourceMapWriter := NewSourceMapWriter(t.FileSet)
+	sourceMapWriter.Write(jsCode)
+
 	var initCalls []byte
 	allTypeNames := []*types.TypeName{types.New("error").(*types.Named).Obj()}
 	loaded := make(map[*types.Package]bool)
@@ -181,7 +296,10 @@ func (t *Translator) BuildPackage(pkg *GopherPackage) error {
 			}
 		}
 
-		jsCode = append(jsCode, []byte("Go$packages[\""+gopherPkg.ImportPath+"\"] = (function() {\n")...)
+		header := []byte("Go$packages[\"" + gopherPkg.ImportPath + "\"] = (function() {\n")
+		jsCode = append(jsCode, header...)
+		sourceMapWriter.Write(header)
+		t.mapPackageLines(sourceMapWriter, gopherPkg, gopherPkg.JavaScriptCode)
 		jsCode = append(jsCode, gopherPkg.JavaScriptCode...)
 		scope := t.TypesConfig.Packages[gopherPkg.ImportPath].Scope()
 		for _, name := range scope.Names() {
@@ -192,7 +310,9 @@ func (t *Translator) BuildPackage(pkg *GopherPackage) error {
 				initCalls = append(initCalls, []byte("Go$packages[\""+gopherPkg.ImportPath+"\"].init();\n")...)
 			}
 		}
-		jsCode = append(jsCode, []byte("})();\n")...)
+		footer := []byte("})();\n")
+		jsCode = append(jsCode, footer...)
+		sourceMapWriter.Write(footer)
 
 		return nil
 	}
@@ -200,19 +320,19 @@ func (t *Translator) BuildPackage(pkg *GopherPackage) error {
 		return err
 	}
 
+	methodIndex := newMethodSetIndex(allTypeNames)
 	for _, t := range allTypeNames {
 		if in, isInterface := t.Type().Underlying().(*types.Interface); isInterface {
 			if in.MethodSet().Len() == 0 {
 				continue
 			}
 			implementedBy := make(map[string]bool, 0)
-			for _, other := range allTypeNames {
-				_, otherIsInterface := other.Type().Underlying().(*types.Interface)
+			for _, other := range methodIndex.candidates(in) {
 				otherType := other.Type()
 				if _, isStruct := otherType.Underlying().(*types.Struct); isStruct {
 					otherType = types.NewPointer(otherType)
 				}
-				if !otherIsInterface && types.IsAssignableTo(otherType, in) {
+				if types.IsAssignableTo(otherType, in) {
 					implementedBy[fmt.Sprintf("Go$packages[\"%s\"].%s", other.Pkg().Path(), other.Name())] = true
 				}
 			}
@@ -231,6 +351,14 @@ func (t *Translator) BuildPackage(pkg *GopherPackage) error {
 	jsCode = append(jsCode, initCalls...)
 	jsCode = append(jsCode, []byte("Go$packages[\""+pkg.ImportPath+"\"].main();\n")...)
 
+	mapFile := pkg.ImportPath + ".js.map"
+	sourceMap, err := sourceMapWriter.Bytes(pkg.ImportPath + ".js")
+	if err != nil {
+		return err
+	}
+	pkg.SourceMap = sourceMap
+	jsCode = append(jsCode, sourceMappingURLComment(mapFile)...)
+
 	pkg.JavaScriptCode = jsCode
 
 	return nil